@@ -3,15 +3,50 @@ package deleter
 import (
 	"fmt"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/service/autoscaling"
 	"github.com/aws/aws-sdk-go/service/autoscaling/autoscalingiface"
 	"github.com/aws/aws-sdk-go/service/iam"
+	"github.com/aws/aws-sdk-go/service/iam/iamiface"
 	"github.com/coreos/grafiti/arn"
 )
 
+// asgDrainPollInterval is how often grafiti checks whether a draining
+// autoscaling group has finished releasing its instances
+const asgDrainPollInterval = 15 * time.Second
+
+// asgNotFoundErrCode is the error code AWS returns when an autoscaling group
+// has already been deleted, making it safe to treat as a no-op success
+const asgNotFoundErrCode = "InvalidGroup.NotFound"
+
+// asgTerminatingHookTransition is the LifecycleTransition value of a
+// terminate-type lifecycle hook; launch-type hooks never have an
+// outstanding action on an instance that's terminating, so
+// CompleteLifecycleAction against one just fails validation
+const asgTerminatingHookTransition = "autoscaling:EC2_INSTANCE_TERMINATING"
+
+// LifecycleHookPolicy describes how grafiti should handle an autoscaling
+// group's launch/terminate lifecycle hooks before the group is deleted
+type LifecycleHookPolicy string
+
+const (
+	// LifecycleHookSkip leaves lifecycle hooks untouched, preserving today's
+	// behavior of relying on ForceDelete to push through any pending actions
+	LifecycleHookSkip LifecycleHookPolicy = "Skip"
+	// LifecycleHookDelete removes every lifecycle hook attached to the group
+	LifecycleHookDelete LifecycleHookPolicy = "Delete"
+	// LifecycleHookComplete completes outstanding lifecycle actions with a
+	// CONTINUE result, allowing instances to finish terminating normally
+	LifecycleHookComplete LifecycleHookPolicy = "Complete"
+	// LifecycleHookAbandon completes outstanding lifecycle actions with an
+	// ABANDON result, immediately failing the instance out of the hook
+	LifecycleHookAbandon LifecycleHookPolicy = "Abandon"
+)
+
 // AutoScalingGroupDeleter represents an AWS autoscaling group
 type AutoScalingGroupDeleter struct {
 	Client        autoscalingiface.AutoScalingAPI
@@ -24,9 +59,9 @@ func (rd *AutoScalingGroupDeleter) String() string {
 }
 
 // GetClient returns an AWS Client, and initalizes one if one has not been
-func (rd *AutoScalingGroupDeleter) GetClient() autoscalingiface.AutoScalingAPI {
+func (rd *AutoScalingGroupDeleter) GetClient(cfg *DeleteConfig) autoscalingiface.AutoScalingAPI {
 	if rd.Client == nil {
-		rd.Client = autoscaling.New(setUpAWSSession())
+		rd.Client = cfg.clientFactory().AutoScaling(cfg.Region)
 	}
 	return rd.Client
 }
@@ -51,17 +86,41 @@ func (rd *AutoScalingGroupDeleter) DeleteResources(cfg *DeleteConfig) error {
 			continue
 		}
 
+		forceDelete := true
+		if cfg.GracefulASGDrain {
+			// Lifecycle hooks only have an outstanding action to resolve once
+			// the group has actually started terminating instances, so
+			// resolution happens inside the drain loop below, not here.
+			drained, derr := rd.drainAutoScalingGroup(cfg, n)
+			if derr != nil {
+				cfg.logDeleteError(arn.AutoScalingGroupRType, n, derr)
+				if !cfg.IgnoreErrors {
+					return derr
+				}
+			}
+			forceDelete = !drained
+		} else if herr := rd.handleLifecycleHooks(cfg, n, make(map[string]bool)); herr != nil {
+			cfg.logDeleteError(arn.AutoScalingGroupRType, n, herr)
+			if !cfg.IgnoreErrors {
+				return herr
+			}
+		}
+
 		params = &autoscaling.DeleteAutoScalingGroupInput{
 			AutoScalingGroupName: n.AWSString(),
-			ForceDelete:          aws.Bool(true),
+			ForceDelete:          aws.Bool(forceDelete),
 		}
 
 		// Prevent throttling
 		time.Sleep(cfg.BackoffTime)
 
 		ctx := aws.BackgroundContext()
-		_, err := rd.GetClient().DeleteAutoScalingGroupWithContext(ctx, params)
+		_, err := rd.GetClient(cfg).DeleteAutoScalingGroupWithContext(ctx, params)
 		if err != nil {
+			if awsErr, ok := err.(awserr.Error); ok && awsErr.Code() == asgNotFoundErrCode {
+				fmt.Println(fmtStr, n)
+				continue
+			}
 			cfg.logDeleteError(arn.AutoScalingGroupRType, n, err)
 			if cfg.IgnoreErrors {
 				continue
@@ -76,34 +135,225 @@ func (rd *AutoScalingGroupDeleter) DeleteResources(cfg *DeleteConfig) error {
 	return nil
 }
 
-// RequestAutoScalingGroups requests autoscaling groups from the AWS API and returns autoscaling
-// groups by names
-func (rd *AutoScalingGroupDeleter) RequestAutoScalingGroups() ([]*autoscaling.Group, error) {
-	if len(rd.ResourceNames) == 0 {
-		return nil, nil
+// drainAutoScalingGroup scales an autoscaling group down to zero and waits
+// for its instances to terminate, so that lifecycle hooks and load balancer
+// connection draining run before grafiti deletes the group out from under
+// them. It reports whether the group finished draining before cfg.ASGDrainTimeout
+// elapsed; callers should fall back to a forced delete when it returns false.
+func (rd *AutoScalingGroupDeleter) drainAutoScalingGroup(cfg *DeleteConfig, n arn.ResourceName) (bool, error) {
+	ctx := aws.BackgroundContext()
+	_, err := rd.GetClient(cfg).UpdateAutoScalingGroupWithContext(ctx, &autoscaling.UpdateAutoScalingGroupInput{
+		AutoScalingGroupName: n.AWSString(),
+		MinSize:              aws.Int64(0),
+		MaxSize:              aws.Int64(0),
+		DesiredCapacity:      aws.Int64(0),
+	})
+	if err != nil {
+		if awsErr, ok := err.(awserr.Error); ok && awsErr.Code() == asgNotFoundErrCode {
+			return true, nil
+		}
+		return false, err
 	}
 
-	params := &autoscaling.DescribeAutoScalingGroupsInput{
-		AutoScalingGroupNames: rd.ResourceNames.AWSStringSlice(),
+	timeout := cfg.ASGDrainTimeout
+	if timeout <= 0 {
+		timeout = 5 * time.Minute
 	}
-	asgs := make([]*autoscaling.Group, 0)
+	deadline := time.Now().Add(timeout)
+
+	// Tracks which instance/hook pairs have already had their lifecycle
+	// action completed, so a later poll tick doesn't call
+	// CompleteLifecycleAction a second time for a pair that's already
+	// resolved, which AWS rejects as having no active action.
+	completed := make(map[string]bool)
 
 	for {
-		ctx := aws.BackgroundContext()
-		resp, err := rd.GetClient().DescribeAutoScalingGroupsWithContext(ctx, params)
-		if err != nil {
-			return nil, err
+		// Now that the scale-down has been triggered, instances will start
+		// moving into Terminating:Wait, so this is where resolving lifecycle
+		// hooks can actually find an outstanding action to complete/abandon.
+		if herr := rd.handleLifecycleHooks(cfg, n, completed); herr != nil {
+			return false, herr
 		}
 
-		for _, asg := range resp.AutoScalingGroups {
-			asgs = append(asgs, asg)
+		asg, rerr := rd.describeOne(cfg, n)
+		if rerr != nil {
+			return false, rerr
 		}
 
-		if resp.NextToken == nil || *resp.NextToken == "" {
-			break
+		if asg == nil || len(asg.Instances) == 0 {
+			return true, nil
+		}
+
+		if time.Now().After(deadline) {
+			fmt.Println("Timed out waiting for AutoScalingGroup to drain, falling back to force delete", n)
+			return false, nil
+		}
+
+		time.Sleep(asgDrainPollInterval)
+	}
+}
+
+// describeOne describes a single autoscaling group by name, rather than
+// rd's whole ResourceNames batch, so that per-group polling (draining,
+// lifecycle hook resolution) doesn't re-describe every group grafiti is
+// deleting on every tick
+func (rd *AutoScalingGroupDeleter) describeOne(cfg *DeleteConfig, n arn.ResourceName) (*autoscaling.Group, error) {
+	single := &AutoScalingGroupDeleter{Client: rd.GetClient(cfg), ResourceType: rd.ResourceType, ResourceNames: arn.ResourceNames{n}}
+	asgs, err := single.RequestAutoScalingGroups(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, asg := range asgs {
+		if asg.AutoScalingGroupName != nil && *asg.AutoScalingGroupName == *n.AWSString() {
+			return asg, nil
+		}
+	}
+	return nil, nil
+}
+
+// handleLifecycleHooks resolves any launch/terminate lifecycle hooks attached
+// to an autoscaling group according to cfg.LifecycleHookPolicy, so that
+// ForceDelete doesn't leave half-executed hook workflows (and their SNS/SQS
+// notification targets) orphaned behind it. completed tracks instance/hook
+// pairs already resolved by a prior call (e.g. an earlier drain poll tick),
+// so they aren't resolved a second time; AWS rejects completing a lifecycle
+// action that's no longer active. Callers with a single resolution pass can
+// pass a fresh map.
+func (rd *AutoScalingGroupDeleter) handleLifecycleHooks(cfg *DeleteConfig, n arn.ResourceName, completed map[string]bool) error {
+	if cfg.LifecycleHookPolicy == "" || cfg.LifecycleHookPolicy == LifecycleHookSkip {
+		return nil
+	}
+
+	ctx := aws.BackgroundContext()
+	resp, err := rd.GetClient(cfg).DescribeLifecycleHooksWithContext(ctx, &autoscaling.DescribeLifecycleHooksInput{
+		AutoScalingGroupName: n.AWSString(),
+	})
+	if err != nil {
+		if awsErr, ok := err.(awserr.Error); ok && awsErr.Code() == asgNotFoundErrCode {
+			return nil
+		}
+		return err
+	}
+	if len(resp.LifecycleHooks) == 0 {
+		return nil
+	}
+
+	if cfg.LifecycleHookPolicy == LifecycleHookDelete {
+		for _, hook := range resp.LifecycleHooks {
+			_, derr := rd.GetClient(cfg).DeleteLifecycleHookWithContext(ctx, &autoscaling.DeleteLifecycleHookInput{
+				AutoScalingGroupName: n.AWSString(),
+				LifecycleHookName:    hook.LifecycleHookName,
+			})
+			if derr != nil {
+				return derr
+			}
+		}
+		return nil
+	}
+
+	result := "CONTINUE"
+	if cfg.LifecycleHookPolicy == LifecycleHookAbandon {
+		result = "ABANDON"
+	}
+
+	asg, rerr := rd.describeOne(cfg, n)
+	if rerr != nil {
+		return rerr
+	}
+	if asg == nil {
+		return nil
+	}
+
+	for _, inst := range asg.Instances {
+		if inst.InstanceId == nil || inst.LifecycleState == nil || !strings.HasPrefix(*inst.LifecycleState, "Terminating:Wait") {
+			continue
+		}
+		for _, hook := range resp.LifecycleHooks {
+			if hook.LifecycleTransition == nil || *hook.LifecycleTransition != asgTerminatingHookTransition || hook.LifecycleHookName == nil {
+				continue
+			}
+
+			key := *inst.InstanceId + "/" + *hook.LifecycleHookName
+			if completed[key] {
+				continue
+			}
+
+			_, cerr := rd.GetClient(cfg).CompleteLifecycleActionWithContext(ctx, &autoscaling.CompleteLifecycleActionInput{
+				AutoScalingGroupName:  n.AWSString(),
+				LifecycleHookName:     hook.LifecycleHookName,
+				InstanceId:            inst.InstanceId,
+				LifecycleActionResult: aws.String(result),
+			})
+			if cerr != nil {
+				return cerr
+			}
+			completed[key] = true
 		}
+	}
+
+	return nil
+}
 
-		params.NextToken = resp.NextToken
+// RequestAutoScalingGroups requests autoscaling groups from the AWS API and returns autoscaling
+// groups by names. Names are batched in groups of requestBatchSize and described concurrently,
+// bounded by cfg.MaxConcurrency and rate-limited by cfg.BackoffTime.
+func (rd *AutoScalingGroupDeleter) RequestAutoScalingGroups(cfg *DeleteConfig) ([]*autoscaling.Group, error) {
+	if len(rd.ResourceNames) == 0 {
+		return nil, nil
+	}
+
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		asgs     = make([]*autoscaling.Group, 0, len(rd.ResourceNames))
+		firstErr error
+		sem      = make(chan struct{}, maxConcurrency(cfg))
+		limiter  = newRateLimiter(cfg.BackoffTime)
+	)
+	defer limiter.Close()
+
+	for _, chunk := range chunkResourceNames(rd.ResourceNames, requestBatchSize) {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(chunk arn.ResourceNames) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			params := &autoscaling.DescribeAutoScalingGroupsInput{
+				AutoScalingGroupNames: chunk.AWSStringSlice(),
+			}
+			var batch []*autoscaling.Group
+			for {
+				limiter.Wait()
+				ctx := aws.BackgroundContext()
+				resp, err := rd.GetClient(cfg).DescribeAutoScalingGroupsWithContext(ctx, params)
+				if err != nil {
+					mu.Lock()
+					if firstErr == nil {
+						firstErr = err
+					}
+					mu.Unlock()
+					return
+				}
+
+				batch = append(batch, resp.AutoScalingGroups...)
+
+				if resp.NextToken == nil || *resp.NextToken == "" {
+					break
+				}
+				params.NextToken = resp.NextToken
+			}
+
+			mu.Lock()
+			asgs = append(asgs, batch...)
+			mu.Unlock()
+		}(chunk)
+	}
+
+	wg.Wait()
+	if firstErr != nil {
+		return nil, firstErr
 	}
 
 	return asgs, nil
@@ -121,9 +371,9 @@ func (rd *AutoScalingLaunchConfigurationDeleter) String() string {
 }
 
 // GetClient returns an AWS Client, and initalizes one if one has not been
-func (rd *AutoScalingLaunchConfigurationDeleter) GetClient() autoscalingiface.AutoScalingAPI {
+func (rd *AutoScalingLaunchConfigurationDeleter) GetClient(cfg *DeleteConfig) autoscalingiface.AutoScalingAPI {
 	if rd.Client == nil {
-		rd.Client = autoscaling.New(setUpAWSSession())
+		rd.Client = cfg.clientFactory().AutoScaling(cfg.Region)
 	}
 	return rd.Client
 }
@@ -156,7 +406,7 @@ func (rd *AutoScalingLaunchConfigurationDeleter) DeleteResources(cfg *DeleteConf
 		time.Sleep(cfg.BackoffTime)
 
 		ctx := aws.BackgroundContext()
-		_, err := rd.GetClient().DeleteLaunchConfigurationWithContext(ctx, params)
+		_, err := rd.GetClient(cfg).DeleteLaunchConfigurationWithContext(ctx, params)
 		if err != nil {
 			cfg.logDeleteError(arn.AutoScalingLaunchConfigurationRType, n, err)
 			if cfg.IgnoreErrors {
@@ -172,46 +422,102 @@ func (rd *AutoScalingLaunchConfigurationDeleter) DeleteResources(cfg *DeleteConf
 }
 
 // RequestAutoScalingLaunchConfigurations requests resources from the AWS API and returns launch
-// configurations by names
-func (rd *AutoScalingLaunchConfigurationDeleter) RequestAutoScalingLaunchConfigurations() ([]*autoscaling.LaunchConfiguration, error) {
+// configurations by names. Names are batched in groups of requestBatchSize and described
+// concurrently, bounded by cfg.MaxConcurrency and rate-limited by cfg.BackoffTime.
+func (rd *AutoScalingLaunchConfigurationDeleter) RequestAutoScalingLaunchConfigurations(cfg *DeleteConfig) ([]*autoscaling.LaunchConfiguration, error) {
 	if len(rd.ResourceNames) == 0 {
 		return nil, nil
 	}
 
-	params := &autoscaling.DescribeLaunchConfigurationsInput{
-		LaunchConfigurationNames: rd.ResourceNames.AWSStringSlice(),
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		lcs      = make([]*autoscaling.LaunchConfiguration, 0, len(rd.ResourceNames))
+		firstErr error
+		sem      = make(chan struct{}, maxConcurrency(cfg))
+		limiter  = newRateLimiter(cfg.BackoffTime)
+	)
+	defer limiter.Close()
+
+	for _, chunk := range chunkResourceNames(rd.ResourceNames, requestBatchSize) {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(chunk arn.ResourceNames) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			params := &autoscaling.DescribeLaunchConfigurationsInput{
+				LaunchConfigurationNames: chunk.AWSStringSlice(),
+			}
+			var batch []*autoscaling.LaunchConfiguration
+			for {
+				limiter.Wait()
+				ctx := aws.BackgroundContext()
+				resp, err := rd.GetClient(cfg).DescribeLaunchConfigurationsWithContext(ctx, params)
+				if err != nil {
+					mu.Lock()
+					if firstErr == nil {
+						firstErr = err
+					}
+					mu.Unlock()
+					return
+				}
+
+				batch = append(batch, resp.LaunchConfigurations...)
+
+				if resp.NextToken == nil || *resp.NextToken == "" {
+					break
+				}
+				params.NextToken = resp.NextToken
+			}
+
+			mu.Lock()
+			lcs = append(lcs, batch...)
+			mu.Unlock()
+		}(chunk)
 	}
-	lcs := make([]*autoscaling.LaunchConfiguration, 0)
 
-	for {
-		ctx := aws.BackgroundContext()
-		resp, err := rd.GetClient().DescribeLaunchConfigurationsWithContext(ctx, params)
-		if err != nil {
-			return nil, err
-		}
+	wg.Wait()
+	if firstErr != nil {
+		return nil, firstErr
+	}
 
-		for _, lc := range resp.LaunchConfigurations {
-			lcs = append(lcs, lc)
-		}
+	return lcs, nil
+}
 
-		if resp.NextToken == nil || *resp.NextToken == "" {
-			break
-		}
+// instanceProfileNameFromLaunchConfiguration extracts an instance profile
+// name from a launch configuration's IamInstanceProfile field, which the AWS
+// docs say may be either a bare name or a full ARN
+func instanceProfileNameFromLaunchConfiguration(lc *autoscaling.LaunchConfiguration) (string, bool) {
+	if lc.IamInstanceProfile == nil {
+		return "", false
+	}
 
-		params.NextToken = resp.NextToken
+	iprName := *lc.IamInstanceProfile
+	if strings.HasPrefix(iprName, "arn:") {
+		iprSplit := strings.Split(iprName, "instance-profile/")
+		if len(iprSplit) != 2 || iprSplit[1] == "" {
+			return "", false
+		}
+		iprName = iprSplit[1]
 	}
 
-	return lcs, nil
+	return iprName, true
 }
 
+// instanceProfileDirectLookupThreshold is the number of wanted instance
+// profile names below which it's cheaper to GetInstanceProfile each one
+// directly than to paginate ListInstanceProfiles across the whole account
+const instanceProfileDirectLookupThreshold = 20
+
 // RequestIAMInstanceProfilesFromLaunchConfigurations retrieves instance profiles from
 // launch configuration names
-func (rd *AutoScalingLaunchConfigurationDeleter) RequestIAMInstanceProfilesFromLaunchConfigurations() ([]*iam.InstanceProfile, error) {
+func (rd *AutoScalingLaunchConfigurationDeleter) RequestIAMInstanceProfilesFromLaunchConfigurations(cfg *DeleteConfig) ([]*iam.InstanceProfile, error) {
 	if len(rd.ResourceNames) == 0 {
 		return nil, nil
 	}
 
-	lcs, rerr := rd.RequestAutoScalingLaunchConfigurations()
+	lcs, rerr := rd.RequestAutoScalingLaunchConfigurations(cfg)
 	if rerr != nil {
 		return nil, rerr
 	}
@@ -219,28 +525,23 @@ func (rd *AutoScalingLaunchConfigurationDeleter) RequestIAMInstanceProfilesFromL
 	// We cannot request instance profiles by their ID's so we must search
 	// iteratively with a map
 	want := map[string]struct{}{}
-	var iprName string
 	for _, lc := range lcs {
-		if lc.IamInstanceProfile == nil {
+		iprName, ok := instanceProfileNameFromLaunchConfiguration(lc)
+		if !ok {
 			continue
 		}
+		want[iprName] = struct{}{}
+	}
 
-		// The docs say that IAMInstanceProfile can be either an ARN or name; if an
-		// ARN, parse out name
-		iprName = *lc.IamInstanceProfile
-		if strings.HasPrefix(*lc.IamInstanceProfile, "arn:") {
-			iprSplit := strings.Split(*lc.IamInstanceProfile, "instance-profile/")
-			if len(iprSplit) != 2 || iprSplit[1] == "" {
-				continue
-			}
-			iprName = iprSplit[1]
-		}
-		if _, ok := want[iprName]; !ok {
-			want[iprName] = struct{}{}
-		}
+	if len(want) == 0 {
+		return nil, nil
 	}
 
-	svc := iam.New(setUpAWSSession())
+	svc := cfg.clientFactory().IAM()
+
+	if len(want) < instanceProfileDirectLookupThreshold {
+		return requestInstanceProfilesDirectly(cfg, svc, want)
+	}
 
 	iprs := make([]*iam.InstanceProfile, 0)
 	params := new(iam.ListInstanceProfilesInput)
@@ -266,3 +567,55 @@ func (rd *AutoScalingLaunchConfigurationDeleter) RequestIAMInstanceProfilesFromL
 
 	return iprs, nil
 }
+
+// requestInstanceProfilesDirectly fetches each wanted instance profile by
+// name in parallel, bounded by cfg.MaxConcurrency, avoiding an O(account)
+// ListInstanceProfiles walk when only a handful of names are needed. A name
+// with no matching profile (already deleted, or never existed) is skipped
+// rather than treated as an error, so re-runs of grafiti stay idempotent.
+func requestInstanceProfilesDirectly(cfg *DeleteConfig, svc iamiface.IAMAPI, want map[string]struct{}) ([]*iam.InstanceProfile, error) {
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		iprs     = make([]*iam.InstanceProfile, 0, len(want))
+		firstErr error
+		sem      = make(chan struct{}, maxConcurrency(cfg))
+		limiter  = newRateLimiter(cfg.BackoffTime)
+	)
+	defer limiter.Close()
+
+	for name := range want {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(name string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			limiter.Wait()
+			ctx := aws.BackgroundContext()
+			resp, err := svc.GetInstanceProfileWithContext(ctx, &iam.GetInstanceProfileInput{InstanceProfileName: aws.String(name)})
+			if err != nil {
+				if awsErr, ok := err.(awserr.Error); ok && awsErr.Code() == iam.ErrCodeNoSuchEntityException {
+					return
+				}
+				mu.Lock()
+				if firstErr == nil {
+					firstErr = err
+				}
+				mu.Unlock()
+				return
+			}
+
+			mu.Lock()
+			iprs = append(iprs, resp.InstanceProfile)
+			mu.Unlock()
+		}(name)
+	}
+
+	wg.Wait()
+	if firstErr != nil {
+		return nil, firstErr
+	}
+
+	return iprs, nil
+}
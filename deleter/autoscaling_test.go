@@ -0,0 +1,68 @@
+package deleter
+
+import (
+	"sync/atomic"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+	"github.com/coreos/grafiti/arn"
+)
+
+func TestDescribeOneScopesToSingleName(t *testing.T) {
+	client := &fakeAutoScalingClient{
+		describeGroups: func(requested []*string) ([]*autoscaling.Group, error) {
+			if len(requested) != 1 {
+				t.Fatalf("expected a single-name describe, got %d names", len(requested))
+			}
+			return []*autoscaling.Group{{AutoScalingGroupName: requested[0]}}, nil
+		},
+	}
+
+	rd := &AutoScalingGroupDeleter{Client: client, ResourceNames: arn.ResourceNames{"a", "b", "c"}}
+	asg, err := rd.describeOne(&DeleteConfig{}, "b")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if asg == nil || *asg.AutoScalingGroupName != "b" {
+		t.Fatalf("expected to describe group %q, got %v", "b", asg)
+	}
+}
+
+func TestHandleLifecycleHooksSkipsAlreadyCompletedPairs(t *testing.T) {
+	var completeCalls int32
+	client := &fakeAutoScalingClient{
+		describeLifecycleHooks: func(*autoscaling.DescribeLifecycleHooksInput) (*autoscaling.DescribeLifecycleHooksOutput, error) {
+			return &autoscaling.DescribeLifecycleHooksOutput{LifecycleHooks: []*autoscaling.LifecycleHook{
+				{LifecycleHookName: aws.String("hook1"), LifecycleTransition: aws.String(asgTerminatingHookTransition)},
+			}}, nil
+		},
+		describeGroups: func([]*string) ([]*autoscaling.Group, error) {
+			return []*autoscaling.Group{{
+				AutoScalingGroupName: aws.String("my-asg"),
+				Instances: []*autoscaling.Instance{
+					{InstanceId: aws.String("i-1"), LifecycleState: aws.String("Terminating:Wait")},
+				},
+			}}, nil
+		},
+		completeLifecycleAction: func(*autoscaling.CompleteLifecycleActionInput) (*autoscaling.CompleteLifecycleActionOutput, error) {
+			atomic.AddInt32(&completeCalls, 1)
+			return &autoscaling.CompleteLifecycleActionOutput{}, nil
+		},
+	}
+
+	rd := &AutoScalingGroupDeleter{Client: client, ResourceNames: arn.ResourceNames{"my-asg"}}
+	cfg := &DeleteConfig{LifecycleHookPolicy: LifecycleHookComplete}
+	completed := make(map[string]bool)
+
+	if err := rd.handleLifecycleHooks(cfg, "my-asg", completed); err != nil {
+		t.Fatalf("unexpected error on first call: %s", err)
+	}
+	if err := rd.handleLifecycleHooks(cfg, "my-asg", completed); err != nil {
+		t.Fatalf("unexpected error on second call: %s", err)
+	}
+
+	if completeCalls != 1 {
+		t.Fatalf("expected CompleteLifecycleAction to be called once across both polls, got %d", completeCalls)
+	}
+}
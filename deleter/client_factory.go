@@ -0,0 +1,87 @@
+package deleter
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+	"github.com/aws/aws-sdk-go/service/autoscaling/autoscalingiface"
+	"github.com/aws/aws-sdk-go/service/iam"
+	"github.com/aws/aws-sdk-go/service/iam/iamiface"
+)
+
+// ClientFactory builds the AWS service clients deleters operate against.
+// Routing client construction through DeleteConfig.Clients instead of having
+// every deleter call setUpAWSSession() directly makes cross-account cleanup,
+// assume-role workflows, and unit testing with mock clients possible.
+type ClientFactory interface {
+	AutoScaling(region string) autoscalingiface.AutoScalingAPI
+	IAM() iamiface.IAMAPI
+}
+
+// defaultClientFactory preserves grafiti's existing behavior of building
+// clients from the ambient session/credentials returned by setUpAWSSession
+type defaultClientFactory struct{}
+
+// DefaultClientFactory is the ClientFactory a DeleteConfig uses when none is set
+var DefaultClientFactory ClientFactory = defaultClientFactory{}
+
+func (defaultClientFactory) AutoScaling(region string) autoscalingiface.AutoScalingAPI {
+	sess := setUpAWSSession()
+	if region != "" {
+		sess = sess.Copy(&aws.Config{Region: aws.String(region)})
+	}
+	return autoscaling.New(sess)
+}
+
+func (defaultClientFactory) IAM() iamiface.IAMAPI {
+	return iam.New(setUpAWSSession())
+}
+
+// AssumedRoleAccount identifies an account grafiti should clean up by
+// assuming a role into it
+type AssumedRoleAccount struct {
+	RoleARN    string
+	ExternalID string
+	Region     string
+}
+
+// assumeRoleClientFactory builds clients scoped to a single assumed-role
+// account and region
+type assumeRoleClientFactory struct {
+	region string
+	creds  *credentials.Credentials
+}
+
+func (f *assumeRoleClientFactory) AutoScaling(region string) autoscalingiface.AutoScalingAPI {
+	if region == "" {
+		region = f.region
+	}
+	sess := session.Must(session.NewSession(&aws.Config{Region: aws.String(region), Credentials: f.creds}))
+	return autoscaling.New(sess)
+}
+
+func (f *assumeRoleClientFactory) IAM() iamiface.IAMAPI {
+	sess := session.Must(session.NewSession(&aws.Config{Region: aws.String(f.region), Credentials: f.creds}))
+	return iam.New(sess)
+}
+
+// NewMultiAccountFactory returns one ClientFactory per account, each
+// assuming the given role via stscreds before building clients. Callers
+// doing cross-account cleanup build a DeleteConfig per returned factory.
+func NewMultiAccountFactory(accounts []AssumedRoleAccount) []ClientFactory {
+	sess := setUpAWSSession()
+
+	factories := make([]ClientFactory, 0, len(accounts))
+	for _, acct := range accounts {
+		creds := stscreds.NewCredentials(sess, acct.RoleARN, func(p *stscreds.AssumeRoleProvider) {
+			if acct.ExternalID != "" {
+				p.ExternalID = aws.String(acct.ExternalID)
+			}
+		})
+		factories = append(factories, &assumeRoleClientFactory{region: acct.Region, creds: creds})
+	}
+
+	return factories
+}
@@ -0,0 +1,90 @@
+package deleter
+
+import (
+	"time"
+
+	"github.com/coreos/grafiti/arn"
+)
+
+// requestBatchSize is the maximum number of resource names AWS accepts in a
+// single DescribeAutoScalingGroups/DescribeLaunchConfigurations call
+const requestBatchSize = 50
+
+// maxConcurrency returns the worker pool size describe requests should fan
+// out across, defaulting to serial execution when unset
+func maxConcurrency(cfg *DeleteConfig) int {
+	if cfg.MaxConcurrency <= 0 {
+		return 1
+	}
+	return cfg.MaxConcurrency
+}
+
+// chunkResourceNames splits ns into slices of at most size names each
+func chunkResourceNames(ns arn.ResourceNames, size int) []arn.ResourceNames {
+	if size <= 0 || size >= len(ns) {
+		return []arn.ResourceNames{ns}
+	}
+
+	chunks := make([]arn.ResourceNames, 0, len(ns)/size+1)
+	for size < len(ns) {
+		ns, chunks = ns[size:], append(chunks, ns[:size])
+	}
+	return append(chunks, ns)
+}
+
+// rateLimiter hands out a token at most once per interval so that requests
+// issued concurrently across a worker pool still honor cfg.BackoffTime in
+// aggregate, rather than each goroutine sleeping BackoffTime independently
+// and losing the bound entirely
+type rateLimiter struct {
+	tokens   chan struct{}
+	stop     chan struct{}
+	disabled bool
+}
+
+// newRateLimiter returns a rateLimiter that admits one request immediately
+// and then at most one every interval. An interval <= 0 disables limiting,
+// so every Wait returns immediately instead of serializing callers behind a
+// single never-refilled token.
+func newRateLimiter(interval time.Duration) *rateLimiter {
+	if interval <= 0 {
+		return &rateLimiter{disabled: true}
+	}
+
+	rl := &rateLimiter{tokens: make(chan struct{}, 1), stop: make(chan struct{})}
+	rl.tokens <- struct{}{}
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				select {
+				case rl.tokens <- struct{}{}:
+				default:
+				}
+			case <-rl.stop:
+				return
+			}
+		}
+	}()
+
+	return rl
+}
+
+// Wait blocks until a token is available
+func (rl *rateLimiter) Wait() {
+	if rl.disabled {
+		return
+	}
+	<-rl.tokens
+}
+
+// Close stops the limiter's background ticker
+func (rl *rateLimiter) Close() {
+	if rl.disabled {
+		return
+	}
+	close(rl.stop)
+}
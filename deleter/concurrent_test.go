@@ -0,0 +1,141 @@
+package deleter
+
+import (
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+	"github.com/aws/aws-sdk-go/service/iam"
+	"github.com/coreos/grafiti/arn"
+)
+
+func TestChunkResourceNames(t *testing.T) {
+	names := arn.ResourceNames{"a", "b", "c", "d", "e"}
+	chunks := chunkResourceNames(names, 2)
+	if len(chunks) != 3 {
+		t.Fatalf("expected 3 chunks, got %d", len(chunks))
+	}
+	if len(chunks[0]) != 2 || len(chunks[1]) != 2 || len(chunks[2]) != 1 {
+		t.Fatalf("unexpected chunk sizes: %v", chunks)
+	}
+}
+
+func TestChunkResourceNamesSmallerThanSize(t *testing.T) {
+	names := arn.ResourceNames{"a", "b"}
+	chunks := chunkResourceNames(names, 50)
+	if len(chunks) != 1 || len(chunks[0]) != 2 {
+		t.Fatalf("expected a single chunk of 2, got %v", chunks)
+	}
+}
+
+func TestMaxConcurrency(t *testing.T) {
+	cfg := &DeleteConfig{}
+	if got := maxConcurrency(cfg); got != 1 {
+		t.Fatalf("expected default concurrency of 1, got %d", got)
+	}
+
+	cfg.MaxConcurrency = 5
+	if got := maxConcurrency(cfg); got != 5 {
+		t.Fatalf("expected configured concurrency of 5, got %d", got)
+	}
+}
+
+func TestRateLimiterDisabledForNonPositiveInterval(t *testing.T) {
+	rl := newRateLimiter(0)
+	defer rl.Close()
+
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < 5; i++ {
+			rl.Wait()
+		}
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("expected Wait to never block when the interval is <= 0")
+	}
+}
+
+func TestRateLimiterPacesRequests(t *testing.T) {
+	rl := newRateLimiter(50 * time.Millisecond)
+	defer rl.Close()
+
+	start := time.Now()
+	rl.Wait()
+	if elapsed := time.Since(start); elapsed > 20*time.Millisecond {
+		t.Fatalf("expected the first token immediately, took %s", elapsed)
+	}
+
+	start = time.Now()
+	rl.Wait()
+	if elapsed := time.Since(start); elapsed < 30*time.Millisecond {
+		t.Fatalf("expected to wait for the next tick, only waited %s", elapsed)
+	}
+}
+
+func TestRequestAutoScalingGroupsBatchesAndMerges(t *testing.T) {
+	const total = 120
+	names := make(arn.ResourceNames, total)
+	for i := range names {
+		names[i] = arn.ResourceName(fmt.Sprintf("asg-%03d", i))
+	}
+
+	var calls int32
+	client := &fakeAutoScalingClient{
+		describeGroups: func(requested []*string) ([]*autoscaling.Group, error) {
+			atomic.AddInt32(&calls, 1)
+			groups := make([]*autoscaling.Group, len(requested))
+			for i, n := range requested {
+				groups[i] = &autoscaling.Group{AutoScalingGroupName: n}
+			}
+			return groups, nil
+		},
+	}
+
+	rd := &AutoScalingGroupDeleter{Client: client, ResourceNames: names}
+	got, err := rd.RequestAutoScalingGroups(&DeleteConfig{MaxConcurrency: 4})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(got) != total {
+		t.Fatalf("expected %d groups, got %d", total, len(got))
+	}
+	if calls != 3 {
+		t.Fatalf("expected 3 batched describe calls for %d names, got %d", total, calls)
+	}
+}
+
+func TestRequestAutoScalingGroupsPropagatesError(t *testing.T) {
+	client := &fakeAutoScalingClient{
+		describeGroups: func([]*string) ([]*autoscaling.Group, error) {
+			return nil, errors.New("boom")
+		},
+	}
+
+	rd := &AutoScalingGroupDeleter{Client: client, ResourceNames: arn.ResourceNames{"a"}}
+	if _, err := rd.RequestAutoScalingGroups(&DeleteConfig{}); err == nil {
+		t.Fatal("expected the describe error to propagate")
+	}
+}
+
+func TestRequestInstanceProfilesDirectlySkipsMissingNames(t *testing.T) {
+	iamClient := &fakeIAMClient{instanceProfiles: map[string]*iam.InstanceProfile{
+		"present": {InstanceProfileName: aws.String("present")},
+	}}
+
+	want := map[string]struct{}{"present": {}, "missing": {}}
+	got, err := requestInstanceProfilesDirectly(&DeleteConfig{}, iamClient, want)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(got) != 1 || *got[0].InstanceProfileName != "present" {
+		t.Fatalf("expected only the present profile to be returned, got %v", got)
+	}
+}
@@ -0,0 +1,60 @@
+package deleter
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/coreos/grafiti/arn"
+)
+
+// drStr prefixes the resources a dry run would have deleted
+const drStr = "Dry run: would have deleted"
+
+// DeleteConfig holds the options and shared dependencies every *Deleter
+// consults when tearing down resources
+type DeleteConfig struct {
+	// DryRun logs what would be deleted without calling any AWS delete API
+	DryRun bool
+	// IgnoreErrors keeps grafiti going after a delete fails for one resource
+	IgnoreErrors bool
+	// BackoffTime is slept between delete calls, and used to rate-limit
+	// concurrent describe calls, to avoid AWS throttling
+	BackoffTime time.Duration
+	// Region is the AWS region resources are deleted from
+	Region string
+	// MaxConcurrency bounds how many describe requests run in parallel;
+	// <= 0 means serial execution
+	MaxConcurrency int
+	// GracefulASGDrain scales an AutoScalingGroup to zero and waits for its
+	// instances to terminate before deleting it, instead of ForceDelete
+	GracefulASGDrain bool
+	// ASGDrainTimeout bounds how long GracefulASGDrain waits before falling
+	// back to a forced delete; <= 0 defaults to 5 minutes
+	ASGDrainTimeout time.Duration
+	// LifecycleHookPolicy controls how an AutoScalingGroup's lifecycle hooks
+	// are resolved before the group is deleted
+	LifecycleHookPolicy LifecycleHookPolicy
+	// Clients builds the AWS service clients deleters use. A nil Clients
+	// falls back to DefaultClientFactory, so a zero-value DeleteConfig keeps
+	// working exactly as it did before ClientFactory was introduced.
+	Clients ClientFactory
+}
+
+// clientFactory returns cfg.Clients, defaulting to DefaultClientFactory when unset
+func (cfg *DeleteConfig) clientFactory() ClientFactory {
+	if cfg.Clients == nil {
+		return DefaultClientFactory
+	}
+	return cfg.Clients
+}
+
+// logDeleteError prints a standard error message for a failed resource deletion
+func (cfg *DeleteConfig) logDeleteError(t arn.ResourceType, n arn.ResourceName, err error) {
+	fmt.Printf("Error deleting %s %s: %s\n", t, n, err)
+}
+
+// setUpAWSSession returns the AWS session used when no ClientFactory is configured
+func setUpAWSSession() *session.Session {
+	return session.Must(session.NewSessionWithOptions(session.Options{SharedConfigState: session.SharedConfigEnable}))
+}
@@ -0,0 +1,71 @@
+package deleter
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+	"github.com/aws/aws-sdk-go/service/autoscaling/autoscalingiface"
+	"github.com/aws/aws-sdk-go/service/iam"
+	"github.com/aws/aws-sdk-go/service/iam/iamiface"
+)
+
+// fakeAutoScalingClient is a minimal autoscalingiface.AutoScalingAPI for
+// tests; embedding the interface satisfies it while letting a test
+// implement only the methods it exercises
+type fakeAutoScalingClient struct {
+	autoscalingiface.AutoScalingAPI
+
+	describeGroups          func(names []*string) ([]*autoscaling.Group, error)
+	describeLCs             func(names []*string) ([]*autoscaling.LaunchConfiguration, error)
+	describeLifecycleHooks  func(in *autoscaling.DescribeLifecycleHooksInput) (*autoscaling.DescribeLifecycleHooksOutput, error)
+	completeLifecycleAction func(in *autoscaling.CompleteLifecycleActionInput) (*autoscaling.CompleteLifecycleActionOutput, error)
+}
+
+func (f *fakeAutoScalingClient) DescribeAutoScalingGroupsWithContext(_ aws.Context, in *autoscaling.DescribeAutoScalingGroupsInput, _ ...request.Option) (*autoscaling.DescribeAutoScalingGroupsOutput, error) {
+	groups, err := f.describeGroups(in.AutoScalingGroupNames)
+	if err != nil {
+		return nil, err
+	}
+	return &autoscaling.DescribeAutoScalingGroupsOutput{AutoScalingGroups: groups}, nil
+}
+
+func (f *fakeAutoScalingClient) DescribeLaunchConfigurationsWithContext(_ aws.Context, in *autoscaling.DescribeLaunchConfigurationsInput, _ ...request.Option) (*autoscaling.DescribeLaunchConfigurationsOutput, error) {
+	lcs, err := f.describeLCs(in.LaunchConfigurationNames)
+	if err != nil {
+		return nil, err
+	}
+	return &autoscaling.DescribeLaunchConfigurationsOutput{LaunchConfigurations: lcs}, nil
+}
+
+func (f *fakeAutoScalingClient) DescribeLifecycleHooksWithContext(_ aws.Context, in *autoscaling.DescribeLifecycleHooksInput, _ ...request.Option) (*autoscaling.DescribeLifecycleHooksOutput, error) {
+	return f.describeLifecycleHooks(in)
+}
+
+func (f *fakeAutoScalingClient) CompleteLifecycleActionWithContext(_ aws.Context, in *autoscaling.CompleteLifecycleActionInput, _ ...request.Option) (*autoscaling.CompleteLifecycleActionOutput, error) {
+	return f.completeLifecycleAction(in)
+}
+
+// fakeIAMClient is a minimal iamiface.IAMAPI for tests
+type fakeIAMClient struct {
+	iamiface.IAMAPI
+
+	instanceProfiles map[string]*iam.InstanceProfile
+}
+
+func (f *fakeIAMClient) GetInstanceProfileWithContext(_ aws.Context, in *iam.GetInstanceProfileInput, _ ...request.Option) (*iam.GetInstanceProfileOutput, error) {
+	ipr, ok := f.instanceProfiles[*in.InstanceProfileName]
+	if !ok {
+		return nil, awserr.New(iam.ErrCodeNoSuchEntityException, "no such entity", nil)
+	}
+	return &iam.GetInstanceProfileOutput{InstanceProfile: ipr}, nil
+}
+
+// fakeClientFactory returns fixed clients regardless of the region/account requested
+type fakeClientFactory struct {
+	asg autoscalingiface.AutoScalingAPI
+	iam iamiface.IAMAPI
+}
+
+func (f *fakeClientFactory) AutoScaling(string) autoscalingiface.AutoScalingAPI { return f.asg }
+func (f *fakeClientFactory) IAM() iamiface.IAMAPI                              { return f.iam }
@@ -0,0 +1,364 @@
+package deleter
+
+import (
+	"fmt"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+	"github.com/aws/aws-sdk-go/service/iam"
+	"github.com/coreos/grafiti/arn"
+)
+
+// dependencyNode is a single resource tracked by a DependencyGraph
+type dependencyNode struct {
+	ID     string
+	Type   arn.ResourceType
+	Delete func(cfg *DeleteConfig) error
+}
+
+// DependencyGraph orders deletions across resource families that reference
+// one another (ASG -> LaunchConfiguration -> InstanceProfile -> Role, for
+// example) so that a resource is only deleted once everything that
+// references it is gone. Without this, independent *Deleters racing against
+// each other commonly fail with errors like LaunchConfiguration's
+// ResourceInUse when a still-live ASG references it.
+type DependencyGraph struct {
+	nodes    map[string]*dependencyNode
+	children map[string]map[string]bool // id -> resources id depends on
+	parents  map[string]map[string]bool // id -> resources that depend on id
+}
+
+// NewDependencyGraph returns an empty DependencyGraph
+func NewDependencyGraph() *DependencyGraph {
+	return &DependencyGraph{
+		nodes:    make(map[string]*dependencyNode),
+		children: make(map[string]map[string]bool),
+		parents:  make(map[string]map[string]bool),
+	}
+}
+
+// AddNode registers a resource with the graph. del is called with the
+// graph's DeleteConfig when the resource is ready to be deleted, i.e. once
+// every resource added via AddEdge(x, id) has already been deleted.
+func (g *DependencyGraph) AddNode(id string, t arn.ResourceType, del func(cfg *DeleteConfig) error) {
+	if _, ok := g.nodes[id]; ok {
+		return
+	}
+	g.nodes[id] = &dependencyNode{ID: id, Type: t, Delete: del}
+	g.children[id] = make(map[string]bool)
+	g.parents[id] = make(map[string]bool)
+}
+
+// RemoveNode drops a resource from the graph entirely, along with any edges
+// referencing it. Used to skip resources that should not be deleted, e.g. a
+// LaunchConfiguration still referenced by an ASG outside the current delete
+// set.
+func (g *DependencyGraph) RemoveNode(id string) {
+	if _, ok := g.nodes[id]; !ok {
+		return
+	}
+	for child := range g.children[id] {
+		delete(g.parents[child], id)
+	}
+	for parent := range g.parents[id] {
+		delete(g.children[parent], id)
+	}
+	delete(g.children, id)
+	delete(g.parents, id)
+	delete(g.nodes, id)
+}
+
+// AddEdge records that parent references child, so child must not be
+// deleted until parent has been. Both ids must already have been added via
+// AddNode.
+func (g *DependencyGraph) AddEdge(parent, child string) {
+	if _, ok := g.nodes[parent]; !ok {
+		return
+	}
+	if _, ok := g.nodes[child]; !ok {
+		return
+	}
+	g.children[parent][child] = true
+	g.parents[child][parent] = true
+}
+
+// Execute deletes every node in the graph, topologically sorted so that a
+// resource is only deleted after everything referencing it (its parents)
+// has already been deleted successfully. A node whose deletion fails blocks
+// its children from being deleted, since grafiti cannot know whether it is
+// still safe to remove them; the failure is reported the same way
+// cfg.IgnoreErrors governs every other deleter.
+func (g *DependencyGraph) Execute(cfg *DeleteConfig) error {
+	ready := make([]string, 0, len(g.nodes))
+	for id := range g.nodes {
+		if len(g.parents[id]) == 0 {
+			ready = append(ready, id)
+		}
+	}
+
+	processed := 0
+	blocked := make(map[string]bool)
+	for len(ready) > 0 {
+		id := ready[0]
+		ready = ready[1:]
+		node := g.nodes[id]
+		processed++
+
+		if blocked[id] {
+			fmt.Println("Skipping", node.Type, id, "since a resource referencing it was not deleted")
+		} else if err := node.Delete(cfg); err != nil {
+			if !cfg.IgnoreErrors {
+				return err
+			}
+			fmt.Println("Skipping dependents of", node.Type, id, "after delete error:", err)
+			blocked[id] = true
+		}
+
+		for child := range g.children[id] {
+			if blocked[id] {
+				blocked[child] = true
+			}
+			delete(g.parents[child], id)
+			if len(g.parents[child]) == 0 {
+				ready = append(ready, child)
+			}
+		}
+	}
+
+	if processed < len(g.nodes) {
+		return fmt.Errorf("deleter: could not resolve deletion order for %d resources, dependency graph may contain a cycle", len(g.nodes)-processed)
+	}
+
+	return nil
+}
+
+// DeleteAutoScalingGroupsAndLaunchConfigurations is the entry point callers
+// should use instead of invoking AutoScalingGroupDeleter,
+// AutoScalingLaunchConfigurationDeleter, and their IAM instance profiles and
+// roles independently. It builds the full ASG -> LaunchConfiguration ->
+// InstanceProfile -> Role DependencyGraph via BuildAutoScalingDependencyGraph
+// and executes it in dependency order.
+func DeleteAutoScalingGroupsAndLaunchConfigurations(cfg *DeleteConfig, asgDeleter *AutoScalingGroupDeleter, lcDeleter *AutoScalingLaunchConfigurationDeleter) error {
+	g, err := BuildAutoScalingDependencyGraph(cfg, asgDeleter, lcDeleter)
+	if err != nil {
+		return err
+	}
+	return g.Execute(cfg)
+}
+
+// BuildAutoScalingDependencyGraph derives an ASG -> LaunchConfiguration ->
+// InstanceProfile -> Role DependencyGraph from the resources an
+// AutoScalingGroupDeleter and AutoScalingLaunchConfigurationDeleter are
+// about to delete, so that each resource is only torn down once everything
+// that references it is gone.
+//
+// A launch configuration still referenced by an ASG outside the current
+// delete set is dropped from the graph with a warning rather than deleted,
+// since AWS would reject it with ResourceInUse anyway.
+func BuildAutoScalingDependencyGraph(cfg *DeleteConfig, asgDeleter *AutoScalingGroupDeleter, lcDeleter *AutoScalingLaunchConfigurationDeleter) (*DependencyGraph, error) {
+	g := NewDependencyGraph()
+
+	inDeleteSet := make(map[string]bool, len(asgDeleter.ResourceNames))
+	for _, n := range asgDeleter.ResourceNames {
+		inDeleteSet[*n.AWSString()] = true
+	}
+
+	asgs, err := asgDeleter.RequestAutoScalingGroups(cfg)
+	if err != nil {
+		return nil, err
+	}
+	for _, asg := range asgs {
+		if asg.AutoScalingGroupName == nil {
+			continue
+		}
+		name := *asg.AutoScalingGroupName
+		single := &AutoScalingGroupDeleter{Client: asgDeleter.Client, ResourceType: asgDeleter.ResourceType, ResourceNames: arn.ResourceNames{arn.ResourceName(name)}}
+		g.AddNode(name, arn.AutoScalingGroupRType, single.DeleteResources)
+	}
+
+	externalRefs, err := externalLaunchConfigurationRefs(cfg, lcDeleter, inDeleteSet)
+	if err != nil {
+		return nil, err
+	}
+
+	lcs, err := lcDeleter.RequestAutoScalingLaunchConfigurations(cfg)
+	if err != nil {
+		return nil, err
+	}
+	for _, lc := range lcs {
+		if lc.LaunchConfigurationName == nil {
+			continue
+		}
+		name := *lc.LaunchConfigurationName
+		if asgName, used := externalRefs[name]; used {
+			fmt.Println("Skipping LaunchConfiguration still referenced by AutoScalingGroup outside delete set:", name, asgName)
+			continue
+		}
+		single := &AutoScalingLaunchConfigurationDeleter{Client: lcDeleter.Client, ResourceType: lcDeleter.ResourceType, ResourceNames: arn.ResourceNames{arn.ResourceName(name)}}
+		g.AddNode(name, arn.AutoScalingLaunchConfigurationRType, single.DeleteResources)
+	}
+
+	for _, asg := range asgs {
+		if asg.AutoScalingGroupName == nil || asg.LaunchConfigurationName == nil {
+			continue
+		}
+		g.AddEdge(*asg.AutoScalingGroupName, *asg.LaunchConfigurationName)
+	}
+
+	iprs, err := lcDeleter.RequestIAMInstanceProfilesFromLaunchConfigurations(cfg)
+	if err != nil {
+		return nil, err
+	}
+	for _, ipr := range iprs {
+		if ipr.InstanceProfileName == nil {
+			continue
+		}
+		iprID := instanceProfileNodeID(*ipr.InstanceProfileName)
+		g.AddNode(iprID, arn.IAMInstanceProfileRType, instanceProfileDeleteFunc(ipr))
+
+		for _, role := range ipr.Roles {
+			if role.RoleName == nil {
+				continue
+			}
+			roleID := roleNodeID(*role.RoleName)
+			g.AddNode(roleID, arn.IAMRoleRType, roleDeleteFunc(*role.RoleName))
+			g.AddEdge(iprID, roleID)
+		}
+	}
+
+	for _, lc := range lcs {
+		if lc.LaunchConfigurationName == nil {
+			continue
+		}
+		if _, skipped := externalRefs[*lc.LaunchConfigurationName]; skipped {
+			continue
+		}
+		iprName, ok := instanceProfileNameFromLaunchConfiguration(lc)
+		if !ok {
+			continue
+		}
+		g.AddEdge(*lc.LaunchConfigurationName, instanceProfileNodeID(iprName))
+	}
+
+	// RequestIAMInstanceProfilesFromLaunchConfigurations resolves instance
+	// profiles from every LaunchConfiguration in lcDeleter.ResourceNames,
+	// including ones skipped above because a live ASG outside the delete set
+	// still references them. Those profiles (and their roles) never get a
+	// parent edge, so prune them here rather than let Execute treat them as
+	// immediately ready and delete a profile/role still attached to a live ASG.
+	for id, node := range g.nodes {
+		if node.Type == arn.IAMInstanceProfileRType && len(g.parents[id]) == 0 {
+			g.RemoveNode(id)
+		}
+	}
+	for id, node := range g.nodes {
+		if node.Type == arn.IAMRoleRType && len(g.parents[id]) == 0 {
+			g.RemoveNode(id)
+		}
+	}
+
+	return g, nil
+}
+
+func instanceProfileNodeID(name string) string { return "instance-profile/" + name }
+func roleNodeID(name string) string            { return "role/" + name }
+
+// instanceProfileDeleteFunc detaches every role from an instance profile
+// before deleting it, since AWS rejects DeleteInstanceProfile while any role
+// is still attached
+func instanceProfileDeleteFunc(ipr *iam.InstanceProfile) func(cfg *DeleteConfig) error {
+	return func(cfg *DeleteConfig) error {
+		if cfg.DryRun {
+			fmt.Println(drStr, "Deleted IAMInstanceProfile", *ipr.InstanceProfileName)
+			return nil
+		}
+
+		svc := cfg.clientFactory().IAM()
+		ctx := aws.BackgroundContext()
+		for _, role := range ipr.Roles {
+			if role.RoleName == nil {
+				continue
+			}
+			_, err := svc.RemoveRoleFromInstanceProfileWithContext(ctx, &iam.RemoveRoleFromInstanceProfileInput{
+				InstanceProfileName: ipr.InstanceProfileName,
+				RoleName:            role.RoleName,
+			})
+			if err != nil && !isIAMNotFoundErr(err) {
+				return err
+			}
+		}
+
+		_, err := svc.DeleteInstanceProfileWithContext(ctx, &iam.DeleteInstanceProfileInput{InstanceProfileName: ipr.InstanceProfileName})
+		if err != nil && !isIAMNotFoundErr(err) {
+			return err
+		}
+
+		fmt.Println("Deleted IAMInstanceProfile", *ipr.InstanceProfileName)
+		return nil
+	}
+}
+
+// roleDeleteFunc deletes an IAM role once nothing references it through the graph
+func roleDeleteFunc(roleName string) func(cfg *DeleteConfig) error {
+	return func(cfg *DeleteConfig) error {
+		if cfg.DryRun {
+			fmt.Println(drStr, "Deleted IAMRole", roleName)
+			return nil
+		}
+
+		ctx := aws.BackgroundContext()
+		_, err := cfg.clientFactory().IAM().DeleteRoleWithContext(ctx, &iam.DeleteRoleInput{RoleName: aws.String(roleName)})
+		if err != nil && !isIAMNotFoundErr(err) {
+			return err
+		}
+
+		fmt.Println("Deleted IAMRole", roleName)
+		return nil
+	}
+}
+
+// isIAMNotFoundErr treats a role/instance profile that's already gone as success
+func isIAMNotFoundErr(err error) bool {
+	awsErr, ok := err.(awserr.Error)
+	return ok && awsErr.Code() == iam.ErrCodeNoSuchEntityException
+}
+
+// externalLaunchConfigurationRefs walks every AutoScalingGroup in the
+// account (not just the ones in the delete set) and returns a map of
+// LaunchConfigurationName -> AutoScalingGroupName for any launch
+// configuration still in use by a group grafiti isn't deleting. Paginated
+// calls are rate-limited by cfg.BackoffTime, like every other describe path.
+func externalLaunchConfigurationRefs(cfg *DeleteConfig, lcDeleter *AutoScalingLaunchConfigurationDeleter, inDeleteSet map[string]bool) (map[string]string, error) {
+	refs := make(map[string]string)
+
+	limiter := newRateLimiter(cfg.BackoffTime)
+	defer limiter.Close()
+
+	ctx := aws.BackgroundContext()
+	params := new(autoscaling.DescribeAutoScalingGroupsInput)
+	for {
+		limiter.Wait()
+		resp, err := lcDeleter.GetClient(cfg).DescribeAutoScalingGroupsWithContext(ctx, params)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, asg := range resp.AutoScalingGroups {
+			if asg.AutoScalingGroupName == nil || asg.LaunchConfigurationName == nil {
+				continue
+			}
+			if inDeleteSet[*asg.AutoScalingGroupName] {
+				continue
+			}
+			refs[*asg.LaunchConfigurationName] = *asg.AutoScalingGroupName
+		}
+
+		if resp.NextToken == nil || *resp.NextToken == "" {
+			break
+		}
+		params.NextToken = resp.NextToken
+	}
+
+	return refs, nil
+}
@@ -0,0 +1,222 @@
+package deleter
+
+import (
+	"errors"
+	"reflect"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+	"github.com/aws/aws-sdk-go/service/iam"
+	"github.com/coreos/grafiti/arn"
+)
+
+func TestDependencyGraphExecuteOrdersParentsBeforeChildren(t *testing.T) {
+	g := NewDependencyGraph()
+
+	var mu sync.Mutex
+	var order []string
+	record := func(id string) func(cfg *DeleteConfig) error {
+		return func(cfg *DeleteConfig) error {
+			mu.Lock()
+			order = append(order, id)
+			mu.Unlock()
+			return nil
+		}
+	}
+
+	g.AddNode("asg", arn.AutoScalingGroupRType, record("asg"))
+	g.AddNode("lc", arn.AutoScalingLaunchConfigurationRType, record("lc"))
+	g.AddNode("ipr", arn.IAMInstanceProfileRType, record("ipr"))
+	g.AddNode("role", arn.IAMRoleRType, record("role"))
+	g.AddEdge("asg", "lc")
+	g.AddEdge("lc", "ipr")
+	g.AddEdge("ipr", "role")
+
+	if err := g.Execute(&DeleteConfig{}); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	want := []string{"asg", "lc", "ipr", "role"}
+	if !reflect.DeepEqual(order, want) {
+		t.Fatalf("got delete order %v, want %v", order, want)
+	}
+}
+
+func TestDependencyGraphExecuteDetectsCycle(t *testing.T) {
+	g := NewDependencyGraph()
+	noop := func(cfg *DeleteConfig) error { return nil }
+	g.AddNode("a", arn.AutoScalingGroupRType, noop)
+	g.AddNode("b", arn.AutoScalingLaunchConfigurationRType, noop)
+	g.AddEdge("a", "b")
+	g.AddEdge("b", "a")
+
+	if err := g.Execute(&DeleteConfig{}); err == nil {
+		t.Fatal("expected a cycle to produce an error")
+	}
+}
+
+func TestDependencyGraphExecuteStopsOnErrorByDefault(t *testing.T) {
+	g := NewDependencyGraph()
+	g.AddNode("parent", arn.AutoScalingGroupRType, func(cfg *DeleteConfig) error { return errors.New("boom") })
+	var childRan bool
+	g.AddNode("child", arn.AutoScalingLaunchConfigurationRType, func(cfg *DeleteConfig) error {
+		childRan = true
+		return nil
+	})
+	g.AddEdge("parent", "child")
+
+	if err := g.Execute(&DeleteConfig{}); err == nil {
+		t.Fatal("expected the parent's delete error to propagate")
+	}
+	if childRan {
+		t.Fatal("child should not be deleted after its parent's delete fails")
+	}
+}
+
+func TestDependencyGraphExecuteIgnoreErrorsSkipsDependents(t *testing.T) {
+	g := NewDependencyGraph()
+	g.AddNode("parent", arn.AutoScalingGroupRType, func(cfg *DeleteConfig) error { return errors.New("boom") })
+	var childRan bool
+	g.AddNode("child", arn.AutoScalingLaunchConfigurationRType, func(cfg *DeleteConfig) error {
+		childRan = true
+		return nil
+	})
+	g.AddEdge("parent", "child")
+
+	if err := g.Execute(&DeleteConfig{IgnoreErrors: true}); err != nil {
+		t.Fatalf("expected no error with IgnoreErrors set, got %s", err)
+	}
+	if childRan {
+		t.Fatal("child should be skipped since its parent was never successfully deleted")
+	}
+}
+
+func TestDependencyGraphRemoveNodeDropsEdges(t *testing.T) {
+	g := NewDependencyGraph()
+	noop := func(cfg *DeleteConfig) error { return nil }
+	g.AddNode("asg", arn.AutoScalingGroupRType, noop)
+	g.AddNode("lc", arn.AutoScalingLaunchConfigurationRType, noop)
+	g.AddEdge("asg", "lc")
+
+	g.RemoveNode("lc")
+
+	if err := g.Execute(&DeleteConfig{}); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if _, ok := g.nodes["lc"]; ok {
+		t.Fatal("expected lc to be removed from the graph")
+	}
+}
+
+func TestBuildAutoScalingDependencyGraphFullChain(t *testing.T) {
+	asgClient := &fakeAutoScalingClient{
+		describeGroups: func(requested []*string) ([]*autoscaling.Group, error) {
+			if len(requested) == 0 {
+				// externalLaunchConfigurationRefs' unfiltered scan
+				return nil, nil
+			}
+			return []*autoscaling.Group{{
+				AutoScalingGroupName:    aws.String("my-asg"),
+				LaunchConfigurationName: aws.String("my-lc"),
+			}}, nil
+		},
+		describeLCs: func(requested []*string) ([]*autoscaling.LaunchConfiguration, error) {
+			return []*autoscaling.LaunchConfiguration{{
+				LaunchConfigurationName: aws.String("my-lc"),
+				IamInstanceProfile:      aws.String("my-profile"),
+			}}, nil
+		},
+	}
+
+	iamClient := &fakeIAMClient{instanceProfiles: map[string]*iam.InstanceProfile{
+		"my-profile": {
+			InstanceProfileName: aws.String("my-profile"),
+			Roles:               []*iam.Role{{RoleName: aws.String("my-role")}},
+		},
+	}}
+
+	cfg := &DeleteConfig{Clients: &fakeClientFactory{asg: asgClient, iam: iamClient}}
+	asgDeleter := &AutoScalingGroupDeleter{Client: asgClient, ResourceNames: arn.ResourceNames{"my-asg"}}
+	lcDeleter := &AutoScalingLaunchConfigurationDeleter{Client: asgClient, ResourceNames: arn.ResourceNames{"my-lc"}}
+
+	g, err := BuildAutoScalingDependencyGraph(cfg, asgDeleter, lcDeleter)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	iprID, roleID := instanceProfileNodeID("my-profile"), roleNodeID("my-role")
+	for _, id := range []string{"my-asg", "my-lc", iprID, roleID} {
+		if _, ok := g.nodes[id]; !ok {
+			t.Fatalf("expected node %q in the graph", id)
+		}
+	}
+
+	if !g.children["my-asg"]["my-lc"] {
+		t.Fatal("expected an edge from the AutoScalingGroup to its LaunchConfiguration")
+	}
+	if !g.children["my-lc"][iprID] {
+		t.Fatal("expected an edge from the LaunchConfiguration to its InstanceProfile")
+	}
+	if !g.children[iprID][roleID] {
+		t.Fatal("expected an edge from the InstanceProfile to its Role")
+	}
+
+	cfg.DryRun = true
+	if err := g.Execute(cfg); err != nil {
+		t.Fatalf("unexpected error executing the graph: %s", err)
+	}
+}
+
+func TestBuildAutoScalingDependencyGraphSkipsExternallyReferencedLaunchConfig(t *testing.T) {
+	asgClient := &fakeAutoScalingClient{
+		describeGroups: func(requested []*string) ([]*autoscaling.Group, error) {
+			if len(requested) == 0 {
+				return []*autoscaling.Group{{
+					AutoScalingGroupName:    aws.String("other-asg"),
+					LaunchConfigurationName: aws.String("my-lc"),
+				}}, nil
+			}
+			return []*autoscaling.Group{{
+				AutoScalingGroupName:    aws.String("my-asg"),
+				LaunchConfigurationName: aws.String("my-lc"),
+			}}, nil
+		},
+		describeLCs: func(requested []*string) ([]*autoscaling.LaunchConfiguration, error) {
+			return []*autoscaling.LaunchConfiguration{{
+				LaunchConfigurationName: aws.String("my-lc"),
+				IamInstanceProfile:      aws.String("my-profile"),
+			}}, nil
+		},
+	}
+
+	iamClient := &fakeIAMClient{instanceProfiles: map[string]*iam.InstanceProfile{
+		"my-profile": {
+			InstanceProfileName: aws.String("my-profile"),
+			Roles:               []*iam.Role{{RoleName: aws.String("my-role")}},
+		},
+	}}
+
+	cfg := &DeleteConfig{Clients: &fakeClientFactory{asg: asgClient, iam: iamClient}}
+	asgDeleter := &AutoScalingGroupDeleter{Client: asgClient, ResourceNames: arn.ResourceNames{"my-asg"}}
+	lcDeleter := &AutoScalingLaunchConfigurationDeleter{Client: asgClient, ResourceNames: arn.ResourceNames{"my-lc"}}
+
+	g, err := BuildAutoScalingDependencyGraph(cfg, asgDeleter, lcDeleter)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if _, ok := g.nodes["my-lc"]; ok {
+		t.Fatal("expected a LaunchConfiguration still referenced outside the delete set to be skipped")
+	}
+
+	// my-profile/my-role are only reachable through the skipped my-lc, so
+	// they must not end up as parentless, immediately-deletable nodes.
+	if _, ok := g.nodes[instanceProfileNodeID("my-profile")]; ok {
+		t.Fatal("expected an InstanceProfile only referenced by a skipped LaunchConfiguration to be pruned")
+	}
+	if _, ok := g.nodes[roleNodeID("my-role")]; ok {
+		t.Fatal("expected a Role only referenced by a skipped LaunchConfiguration to be pruned")
+	}
+}